@@ -2,17 +2,29 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
@@ -20,169 +32,1020 @@ var (
 	listenAddress = flag.String("web.listen-address", ":9617", "Address to listen on for telemetry")
 	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics")
 	arpwatchFile  = flag.String("arpwatch.file", "/var/lib/arpwatch/arp.dat", "Path to the arpwatch data file")
-	
+
+	arpwatchMinScrapeInterval = flag.Duration("arpwatch.min-scrape-interval", 5*time.Second, "Minimum interval between arpwatch file parses; repeat scrapes within this window are served from cache")
+
+	arpwatchOUIFile   = flag.String("arpwatch.oui-file", "", "Path to an IEEE OUI CSV or Wireshark manuf file for MAC vendor enrichment (disabled if empty)")
+	arpwatchOUIReload = flag.Duration("arpwatch.oui-reload", 60*time.Second, "How often to check the OUI file for changes (zero or negative disables reloading)")
+
+	arpwatchStateFile       = flag.String("arpwatch.state-file", "", "Path to a JSON file for persisting device history across restarts, used for new-device/flip-flop detection (disabled if empty, history is kept in-memory only)")
+	arpwatchFlipMinInterval = flag.Duration("arpwatch.flip-min-interval", 0, "Minimum interval between recorded flip events for the same MAC; rapid oscillations within this window are suppressed (0 disables suppression)")
+
 	// Authentication flags
-	authUsername  = flag.String("auth.username", "", "Username for basic auth (disabled if empty)")
-	authPassword  = flag.String("auth.password", "", "Password for basic auth (disabled if empty)")
-	
-	// Prometheus metrics
-	lastSeenTimestamp = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "arpwatch_device_last_seen_timestamp",
-			Help: "Unix timestamp when a MAC address was last seen",
-		},
-		[]string{"mac", "ip", "hostname"},
-	)
-	
-	fileReadErrors = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "arpwatch_exporter_read_errors_total",
-			Help: "Total number of arpwatch file read errors",
-		},
-	)
-	
-	lastFileReadTime = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "arpwatch_exporter_last_read_timestamp",
-			Help: "Unix timestamp of the last successful file read",
-		},
-	)
-	
-	devicesTracked = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "arpwatch_devices_tracked_total",
-			Help: "Total number of devices currently being tracked",
-		},
-	)
+	authUsername = flag.String("auth.username", "", "Username for basic auth (disabled if empty)")
+	authPassword = flag.String("auth.password", "", "Password for basic auth (disabled if empty)")
+
+	authHtpasswdFile   = flag.String("auth.htpasswd-file", "", "Path to an htpasswd file for multi-user basic auth (disabled if empty)")
+	authHtpasswdReload = flag.Duration("auth.htpasswd-reload", 15*time.Second, "How often to check the htpasswd file for changes (zero or negative disables reloading)")
+	authMode           = flag.String("auth.mode", "", "Authentication mode: none, basic, htpasswd, or cert (inferred from other auth flags if empty)")
+
+	// TLS flags
+	tlsCertFile     = flag.String("web.tls-cert", "", "Path to a TLS certificate file (enables HTTPS)")
+	tlsKeyFile      = flag.String("web.tls-key", "", "Path to the TLS private key file matching web.tls-cert")
+	tlsClientCAFile = flag.String("web.tls-client-ca", "", "Path to a PEM CA bundle used to verify client certificates (required for auth.mode=cert)")
+
+	// Logging flags
+	logLevel  = flag.String("log.level", "info", "Minimum log level: debug, info, warn, or error")
+	logFormat = flag.String("log.format", "logfmt", "Log output format: logfmt or json")
+
+	logFile       = flag.String("log.file", "", "Optional file to write logs to instead of stderr, rotated by the flags below (only applies when set)")
+	logMaxSizeMB  = flag.Int("log.max-size-mb", 100, "Maximum size in megabytes of the log file before it gets rotated")
+	logMaxBackups = flag.Int("log.max-backups", 3, "Maximum number of old rotated log files to retain")
+	logMaxAgeDays = flag.Int("log.max-age-days", 28, "Maximum number of days to retain old rotated log files")
+	logCompress   = flag.Bool("log.compress", false, "Compress rotated log files")
+
+	// logger is configured at startup by setupLogger and used throughout.
+	logger *slog.Logger
+
+	// htpasswdStore backs auth.htpasswd-file, nil when that flag is unset.
+	htpasswdStore *htpasswdUserStore
 )
 
-func init() {
-	// Register metrics with Prometheus
-	prometheus.MustRegister(lastSeenTimestamp)
-	prometheus.MustRegister(fileReadErrors)
-	prometheus.MustRegister(lastFileReadTime)
-	prometheus.MustRegister(devicesTracked)
+// arpwatchDevice is one parsed line of the arpwatch data file.
+type arpwatchDevice struct {
+	mac       string
+	ip        string
+	hostname  string
+	timestamp float64
 }
 
-func readArpwatchData(filePath string) {
-	file, err := os.Open(filePath)
+// parseArpwatchFile reads and parses the arpwatch data file at path,
+// returning one arpwatchDevice per valid line.
+func parseArpwatchFile(path string) ([]arpwatchDevice, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("Error opening arpwatch file: %v", err)
-		fileReadErrors.Inc()
-		return
+		return nil, err
 	}
 	defer file.Close()
-	// Clear previous data before updating
-	lastSeenTimestamp.Reset()
-	
+
+	var devices []arpwatchDevice
 	scanner := bufio.NewScanner(file)
-	deviceCount := 0
-	
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue // Skip empty lines and comments
 		}
-		
+
 		parts := strings.Fields(line)
 		if len(parts) < 3 {
-			log.Printf("Invalid line format: %s", line)
+			logger.Warn("invalid arpwatch line", "line", line)
 			continue
 		}
-		
+
 		mac := parts[0]
 		ip := parts[1]
 		timestamp, err := strconv.ParseInt(parts[2], 10, 64)
 		if err != nil {
-			log.Printf("Invalid timestamp format: %s", parts[2])
+			logger.Warn("invalid arpwatch timestamp", "value", parts[2])
 			continue
 		}
-		
+
 		// Include hostname as a label if available
 		hostname := ""
 		if len(parts) >= 4 {
 			hostname = parts[3]
 		}
-		lastSeenTimestamp.WithLabelValues(mac, ip, hostname).Set(float64(timestamp))
-		deviceCount++
+		devices = append(devices, arpwatchDevice{mac: mac, ip: ip, hostname: hostname, timestamp: float64(timestamp)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// ArpwatchCollector implements prometheus.Collector, parsing the arpwatch
+// file on each scrape (subject to minScrapeInterval) instead of relying on
+// a background goroutine and package-level gauges. This removes the fixed
+// staleness window of the old push model and the Reset()-then-rebuild
+// window where a concurrent scrape could observe zero devices.
+type ArpwatchCollector struct {
+	filePath          string
+	minScrapeInterval time.Duration
+	oui               *OUIStore
+	stateFile         string
+	flipMinInterval   time.Duration
+
+	mu             sync.Mutex
+	devices        []arpwatchDevice
+	lastScrape     time.Time
+	lastReadTime   float64
+	scrapeDuration float64
+	scrapeSuccess  float64
+	readErrors     float64
+
+	knownState      map[string]persistedDevice
+	newDeviceEvents *prometheus.CounterVec
+	flipEvents      *prometheus.CounterVec
+}
+
+// persistedDevice is one MAC's last known IP and flip history, as stored in
+// -arpwatch.state-file.
+type persistedDevice struct {
+	IP       string     `json:"ip"`
+	LastFlip *time.Time `json:"last_flip,omitempty"`
+}
+
+var (
+	arpwatchDeviceDesc = prometheus.NewDesc(
+		"arpwatch_device_last_seen_timestamp",
+		"Unix timestamp when a MAC address was last seen",
+		[]string{"mac", "ip", "hostname"}, nil,
+	)
+	arpwatchDevicesTrackedDesc = prometheus.NewDesc(
+		"arpwatch_devices_tracked_total",
+		"Total number of devices currently being tracked",
+		nil, nil,
+	)
+	arpwatchReadErrorsDesc = prometheus.NewDesc(
+		"arpwatch_exporter_read_errors_total",
+		"Total number of arpwatch file read errors",
+		nil, nil,
+	)
+	arpwatchLastReadTimeDesc = prometheus.NewDesc(
+		"arpwatch_exporter_last_read_timestamp",
+		"Unix timestamp of the last successful file read",
+		nil, nil,
+	)
+	arpwatchScrapeDurationDesc = prometheus.NewDesc(
+		"arpwatch_scrape_duration_seconds",
+		"Duration of the last arpwatch file parse",
+		nil, nil,
+	)
+	arpwatchScrapeSuccessDesc = prometheus.NewDesc(
+		"arpwatch_scrape_success",
+		"Whether the last arpwatch file parse succeeded (1) or not (0)",
+		nil, nil,
+	)
+	arpwatchDeviceInfoDesc = prometheus.NewDesc(
+		"arpwatch_device_info",
+		"Device vendor enrichment, value is always 1",
+		[]string{"mac", "ip", "hostname", "vendor"}, nil,
+	)
+	arpwatchOUIEntriesDesc = prometheus.NewDesc(
+		"arpwatch_oui_entries",
+		"Number of MAC OUI vendor entries currently loaded",
+		nil, nil,
+	)
+)
+
+// NewArpwatchCollector returns a collector that reads filePath on demand,
+// caching results for minScrapeInterval to avoid hammering the disk when
+// more than one Prometheus scrapes this exporter. oui may be nil to disable
+// vendor enrichment. If stateFile is non-empty, previously-seen MAC/IP
+// history is loaded from it and kept up to date as the file is reparsed.
+func NewArpwatchCollector(filePath string, minScrapeInterval time.Duration, oui *OUIStore, stateFile string, flipMinInterval time.Duration) (*ArpwatchCollector, error) {
+	c := &ArpwatchCollector{
+		filePath:          filePath,
+		minScrapeInterval: minScrapeInterval,
+		oui:               oui,
+		stateFile:         stateFile,
+		flipMinInterval:   flipMinInterval,
+		knownState:        make(map[string]persistedDevice),
+		newDeviceEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arpwatch_new_device_events_total",
+			Help: "Total number of times a previously unseen MAC address was observed",
+		}, []string{"mac", "ip"}),
+		flipEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arpwatch_flip_events_total",
+			Help: "Total number of times a known MAC address was observed on a different IP address",
+		}, []string{"mac", "old_ip", "new_ip"}),
+	}
+
+	if stateFile != "" {
+		state, err := loadState(stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn("ignoring unreadable arpwatch state file, starting with empty history", "file", stateFile, "err", err)
+		} else if state != nil {
+			c.knownState = state
+		}
+	}
+
+	return c, nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *ArpwatchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- arpwatchDeviceDesc
+	ch <- arpwatchDevicesTrackedDesc
+	ch <- arpwatchReadErrorsDesc
+	ch <- arpwatchLastReadTimeDesc
+	ch <- arpwatchScrapeDurationDesc
+	ch <- arpwatchScrapeSuccessDesc
+	if c.oui != nil {
+		ch <- arpwatchDeviceInfoDesc
+		ch <- arpwatchOUIEntriesDesc
+	}
+	c.newDeviceEvents.Describe(ch)
+	c.flipEvents.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, refreshing the cached parse of
+// the arpwatch file when it is missing or older than minScrapeInterval, then
+// emitting a consistent snapshot.
+func (c *ArpwatchCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.lastScrape.IsZero() || c.minScrapeInterval <= 0 || now.Sub(c.lastScrape) >= c.minScrapeInterval {
+		c.refreshLocked(now)
+	}
+
+	for _, d := range c.devices {
+		ch <- prometheus.MustNewConstMetric(arpwatchDeviceDesc, prometheus.GaugeValue, d.timestamp, d.mac, d.ip, d.hostname)
+	}
+	ch <- prometheus.MustNewConstMetric(arpwatchDevicesTrackedDesc, prometheus.GaugeValue, float64(len(c.devices)))
+	ch <- prometheus.MustNewConstMetric(arpwatchReadErrorsDesc, prometheus.CounterValue, c.readErrors)
+	ch <- prometheus.MustNewConstMetric(arpwatchLastReadTimeDesc, prometheus.GaugeValue, c.lastReadTime)
+	ch <- prometheus.MustNewConstMetric(arpwatchScrapeDurationDesc, prometheus.GaugeValue, c.scrapeDuration)
+	ch <- prometheus.MustNewConstMetric(arpwatchScrapeSuccessDesc, prometheus.GaugeValue, c.scrapeSuccess)
+
+	if c.oui != nil {
+		for _, d := range c.devices {
+			vendor := c.oui.lookup(d.mac)
+			ch <- prometheus.MustNewConstMetric(arpwatchDeviceInfoDesc, prometheus.GaugeValue, 1, d.mac, d.ip, d.hostname, vendor)
+		}
+		ch <- prometheus.MustNewConstMetric(arpwatchOUIEntriesDesc, prometheus.GaugeValue, float64(c.oui.count()))
+	}
+
+	c.newDeviceEvents.Collect(ch)
+	c.flipEvents.Collect(ch)
+}
+
+// refreshLocked reparses the arpwatch file, called with c.mu held. On
+// failure it keeps serving the last known-good device set rather than
+// dropping to zero devices.
+func (c *ArpwatchCollector) refreshLocked(now time.Time) {
+	devices, err := parseArpwatchFile(c.filePath)
+	c.scrapeDuration = time.Since(now).Seconds()
+	c.lastScrape = now
+
+	if err != nil {
+		logger.Error("error reading arpwatch file", "err", err)
+		c.readErrors++
+		c.scrapeSuccess = 0
+		return
+	}
+
+	c.detectAnomalies(devices, now)
+
+	c.devices = dedupeDevices(devices)
+	c.lastReadTime = float64(now.Unix())
+	c.scrapeSuccess = 1
+}
+
+// dedupeDevices collapses devices sharing a mac/ip/hostname label set down
+// to a single entry, keeping the one with the highest timestamp. Without
+// this, a duplicate or corrupt arp.dat line would make registry.Gather
+// reject the scrape outright instead of just overwriting the stale value.
+func dedupeDevices(devices []arpwatchDevice) []arpwatchDevice {
+	byLabels := make(map[string]arpwatchDevice, len(devices))
+	for _, d := range devices {
+		key := d.mac + "\x00" + d.ip + "\x00" + d.hostname
+		if existing, ok := byLabels[key]; !ok || d.timestamp > existing.timestamp {
+			byLabels[key] = d
+		}
+	}
+
+	deduped := make([]arpwatchDevice, 0, len(byLabels))
+	for _, d := range byLabels {
+		deduped = append(deduped, d)
+	}
+	return deduped
+}
+
+// detectAnomalies compares the freshly parsed devices against c.knownState,
+// incrementing arpwatch_new_device_events_total the first time a MAC is
+// seen and arpwatch_flip_events_total when a known MAC's IP changes,
+// mirroring arpwatch's classic "new station"/"flip flop" alerts. It is
+// called with c.mu held.
+func (c *ArpwatchCollector) detectAnomalies(devices []arpwatchDevice, now time.Time) {
+	current := make(map[string]arpwatchDevice, len(devices))
+	for _, d := range devices {
+		if existing, ok := current[d.mac]; !ok || d.timestamp > existing.timestamp {
+			current[d.mac] = d
+		}
+	}
+
+	changed := false
+	for mac, d := range current {
+		prev, known := c.knownState[mac]
+		switch {
+		case !known:
+			c.newDeviceEvents.WithLabelValues(mac, d.ip).Inc()
+			c.knownState[mac] = persistedDevice{IP: d.ip}
+			changed = true
+		case prev.IP != d.ip:
+			if c.flipMinInterval <= 0 || prev.LastFlip == nil || now.Sub(*prev.LastFlip) >= c.flipMinInterval {
+				c.flipEvents.WithLabelValues(mac, prev.IP, d.ip).Inc()
+				c.knownState[mac] = persistedDevice{IP: d.ip, LastFlip: &now}
+				changed = true
+			}
+		}
+	}
+
+	if changed && c.stateFile != "" {
+		if err := saveState(c.stateFile, c.knownState); err != nil {
+			logger.Error("error saving arpwatch state file", "err", err)
+		}
+	}
+}
+
+// loadState reads the persisted MAC history from path.
+func loadState(path string) (map[string]persistedDevice, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(map[string]persistedDevice)
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveState writes the MAC history to path, via a temp file plus rename so
+// a crash mid-write can't leave a truncated state file behind.
+func saveState(path string, state map[string]persistedDevice) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const unknownVendor = "unknown"
+
+// OUIStore holds a hot-reloadable MAC-OUI-prefix -> vendor name map, parsed
+// from an IEEE OUI CSV registry export or a Wireshark-style manuf file.
+type OUIStore struct {
+	path string
+
+	mu      sync.RWMutex
+	vendors map[string]string
+
+	lastModTime time.Time
+	lastSize    int64
+}
+
+// newOUIStore loads path and returns a store ready for use.
+func newOUIStore(path string) (*OUIStore, error) {
+	s := &OUIStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// normalizeOUIPrefix strips MAC separators and returns the uppercased
+// 24-bit (6 hex char) OUI prefix, or "" if mac is too short or the first
+// six characters aren't all hex digits (e.g. a CSV header row).
+func normalizeOUIPrefix(mac string) string {
+	clean := strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(clean) < 6 {
+		return ""
+	}
+	prefix := clean[:6]
+	for _, r := range prefix {
+		if (r < '0' || r > '9') && (r < 'A' || r > 'F') {
+			return ""
+		}
+	}
+	return prefix
+}
+
+// reload re-reads the OUI file unconditionally and swaps the in-memory map
+// atomically. It accepts both the IEEE "MA-L,XXXXXX,Organization" CSV export
+// and Wireshark manuf files ("XX:XX:XX<tab>Vendor").
+func (s *OUIStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var prefix, vendor string
+		if strings.Contains(line, ",") {
+			r := csv.NewReader(strings.NewReader(line))
+			if fields, err := r.Read(); err == nil && len(fields) >= 3 {
+				prefix = normalizeOUIPrefix(fields[1])
+				vendor = strings.TrimSpace(fields[2])
+			}
+		} else if fields := strings.Fields(line); len(fields) >= 2 {
+			prefix = normalizeOUIPrefix(fields[0])
+			vendor = strings.Join(fields[1:], " ")
+		}
+
+		if prefix == "" || vendor == "" {
+			continue
+		}
+		vendors[prefix] = vendor
 	}
-	
 	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading arpwatch file: %v", err)
-		fileReadErrors.Inc()
+		return err
+	}
+
+	s.mu.Lock()
+	s.vendors = vendors
+	s.lastModTime = info.ModTime()
+	s.lastSize = info.Size()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged reloads the file only when its mtime or size differs from
+// what was last loaded.
+func (s *OUIStore) reloadIfChanged() {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		logger.Error("error stating oui file", "err", err)
 		return
 	}
-	
-	devicesTracked.Set(float64(deviceCount))
-	lastFileReadTime.Set(float64(time.Now().Unix()))
+
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.lastModTime) || info.Size() != s.lastSize
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		logger.Error("error reloading oui file", "err", err)
+	}
 }
 
-func updateMetrics() {
+// watch periodically calls reloadIfChanged until interval is zero or negative.
+func (s *OUIStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
 	for {
-		readArpwatchData(*arpwatchFile)
-		time.Sleep(30 * time.Second)
+		time.Sleep(interval)
+		s.reloadIfChanged()
 	}
 }
 
-// basicAuth implements HTTP Basic Authentication middleware
-func basicAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if authentication is enabled
-		if *authUsername == "" || *authPassword == "" {
-			next.ServeHTTP(w, r)
-			return
+// lookup returns the vendor name for mac's OUI prefix, or unknownVendor if
+// it is not present in the loaded table.
+func (s *OUIStore) lookup(mac string) string {
+	prefix := normalizeOUIPrefix(mac)
+	if prefix == "" {
+		return unknownVendor
+	}
+
+	s.mu.RLock()
+	vendor, ok := s.vendors[prefix]
+	s.mu.RUnlock()
+	if !ok {
+		return unknownVendor
+	}
+	return vendor
+}
+
+// count returns the number of loaded OUI entries.
+func (s *OUIStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.vendors)
+}
+
+// htpasswdUserStore holds a hot-reloadable username -> hash map parsed from
+// an htpasswd-style file, so operators can rotate scraper credentials
+// without restarting the exporter.
+type htpasswdUserStore struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+
+	lastModTime time.Time
+	lastSize    int64
+}
+
+// newHtpasswdUserStore loads path and returns a store ready for use.
+func newHtpasswdUserStore(path string) (*htpasswdUserStore, error) {
+	s := &htpasswdUserStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the htpasswd file unconditionally and swaps the in-memory
+// map atomically.
+func (s *htpasswdUserStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		
-		// Get credentials from request header
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			unauthorized(w)
-			return
+
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			logger.Warn("skipping malformed htpasswd line", "line", line)
+			continue
+		}
+
+		username := line[:idx]
+		hash := line[idx+1:]
+		if username == "" || hash == "" {
+			logger.Warn("skipping malformed htpasswd line", "line", line)
+			continue
+		}
+		users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.lastModTime = info.ModTime()
+	s.lastSize = info.Size()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged reloads the file only when its mtime or size differs from
+// what was last loaded, so a busy reload interval doesn't mean constant disk
+// reads.
+func (s *htpasswdUserStore) reloadIfChanged() {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		logger.Error("error stating htpasswd file", "err", err)
+		return
+	}
+
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.lastModTime) || info.Size() != s.lastSize
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		logger.Error("error reloading htpasswd file", "err", err)
+	}
+}
+
+// watch periodically calls reloadIfChanged until interval is zero or negative.
+func (s *htpasswdUserStore) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		s.reloadIfChanged()
+	}
+}
+
+// authenticate reports whether password is valid for username, comparing
+// against the bcrypt, {SHA} or apr1-MD5 hash stored for that user.
+func (s *htpasswdUserStore) authenticate(username, password string) bool {
+	s.mu.RLock()
+	hash, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		expected := apr1Crypt(password, hash)
+		return expected != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	default:
+		logger.Warn("unsupported htpasswd hash format", "user", username)
+		return false
+	}
+}
+
+// apr1Crypt computes the Apache apr1-MD5 crypt of password using the salt
+// extracted from sample, which is either a bare salt or a full
+// "$apr1$salt$hash" line.
+func apr1Crypt(password, sample string) string {
+	salt := sample
+	if strings.HasPrefix(sample, "$apr1") && !strings.HasPrefix(sample, "$apr1$") {
+		return ""
+	}
+	if strings.HasPrefix(sample, "$apr1$") {
+		parts := strings.Split(sample, "$")
+		// parts[0] is "", parts[1] is "apr1", parts[2] is the salt.
+		if len(parts) < 3 {
+			return ""
+		}
+		salt = parts[2]
+	}
+
+	magic := "$apr1$"
+
+	ctx1 := md5.New()
+	ctx1.Write([]byte(password))
+	ctx1.Write([]byte(salt))
+	ctx1.Write([]byte(password))
+	final := ctx1.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write([]byte(password))
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte(password[:1]))
 		}
-		
-		// Use constant time comparison to prevent timing attacks
-		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(*authUsername))
-		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(*authPassword))
-		
-		if usernameMatch == 1 && passwordMatch == 1 {
-			next.ServeHTTP(w, r)
+	}
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx2 := md5.New()
+		if i&1 != 0 {
+			ctx2.Write([]byte(password))
+		} else {
+			ctx2.Write(final)
+		}
+		if i%3 != 0 {
+			ctx2.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx2.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			ctx2.Write(final)
+		} else {
+			ctx2.Write([]byte(password))
+		}
+		final = ctx2.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic)
+	out.WriteString(salt)
+	out.WriteString("$")
+
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint32(b2)<<16 | uint32(b1)<<8 | uint32(b0)
+		for i := 0; i < n; i++ {
+			out.WriteByte(itoa64[w&0x3f])
+			w >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+
+	return out.String()
+}
+
+// basicAuth implements HTTP Basic Authentication middleware, enforcing only
+// the check appropriate to the resolved auth mode rather than inferring
+// behavior from which credential flags happen to be set.
+func basicAuth(mode string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mode == "none" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Get credentials from request header
+			username, password, ok := r.BasicAuth()
+			if !ok {
+				unauthorized(w)
+				return
+			}
+
+			switch mode {
+			case "basic":
+				// Use constant time comparison to prevent timing attacks
+				usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(*authUsername))
+				passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(*authPassword))
+				if usernameMatch == 1 && passwordMatch == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			case "htpasswd":
+				if htpasswdStore.authenticate(username, password) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			unauthorized(w)
+		})
+	}
+}
+
+// certAuth implements TLS client-certificate authentication middleware, for
+// use behind a tls.Config with RequireAndVerifyClientCert so that only peers
+// with a certificate chaining to web.tls-client-ca reach the handler.
+func certAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
 			return
 		}
-		
-		unauthorized(w)
+		next.ServeHTTP(w, r)
 	})
 }
 
+// resolveAuthMode validates auth.mode, or infers it from the other auth
+// flags when it is left empty so existing deployments keep working
+// unchanged.
+func resolveAuthMode() (string, error) {
+	switch *authMode {
+	case "":
+		switch {
+		case *authHtpasswdFile != "":
+			return "htpasswd", nil
+		case *authUsername != "" && *authPassword != "":
+			return "basic", nil
+		default:
+			return "none", nil
+		}
+	case "basic":
+		if *authUsername == "" || *authPassword == "" {
+			return "", fmt.Errorf("-auth.mode=basic requires -auth.username and -auth.password")
+		}
+		return "basic", nil
+	case "htpasswd":
+		if *authHtpasswdFile == "" {
+			return "", fmt.Errorf("-auth.mode=htpasswd requires -auth.htpasswd-file")
+		}
+		return "htpasswd", nil
+	case "none", "cert":
+		return *authMode, nil
+	default:
+		return "", fmt.Errorf("invalid -auth.mode %q: must be none, basic, htpasswd, or cert", *authMode)
+	}
+}
+
+// newTLSConfig builds the server tls.Config for web.tls-cert/web.tls-key,
+// pinning a modern minimum version and requiring a verified client
+// certificate when requireClientCert is set.
+func newTLSConfig(clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		PreferServerCipherSuites: true,
+	}
+
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+
+	caCert, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
 func unauthorized(w http.ResponseWriter) {
 	w.Header().Set("WWW-Authenticate", `Basic realm="Arpwatch Exporter"`)
 	w.WriteHeader(http.StatusUnauthorized)
 	w.Write([]byte("Unauthorized\n"))
 }
 
+// parseLogLevel maps a -log.level value to the corresponding slog.Level.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid -log.level %q: must be debug, info, warn, or error", s)
+	}
+}
+
+// setupLogger builds the package logger from the -log.* flags, writing to
+// stderr unless -log.file is set, in which case output is rotated by
+// lumberjack using the -log.max-* flags.
+func setupLogger() (*slog.Logger, error) {
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	var output io.Writer = os.Stderr
+	if *logFile != "" {
+		output = &lumberjack.Logger{
+			Filename:   *logFile,
+			MaxSize:    *logMaxSizeMB,
+			MaxBackups: *logMaxBackups,
+			MaxAge:     *logMaxAgeDays,
+			Compress:   *logCompress,
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(*logFormat) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(output, opts)), nil
+	case "logfmt", "":
+		return slog.New(slog.NewTextHandler(output, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid -log.format %q: must be logfmt or json", *logFormat)
+	}
+}
+
+// fatal logs msg at error level and exits, mirroring the log.Fatal
+// convention this exporter used before switching to slog.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// statusRecorder captures the status code written by a handler so accessLog
+// can report it after the fact.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog wraps next with a per-request log line at info level recording
+// method, path, status, duration, and remote address.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		logger.Info("http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
 func main() {
 	flag.Parse()
-	
-	log.Printf("Starting arpwatch exporter on %s", *listenAddress)
-	log.Printf("Metrics available at %s%s", *listenAddress, *metricsPath)
-	log.Printf("Reading arpwatch data from %s", *arpwatchFile)
-	
-	// Print authentication status
-	if *authUsername != "" && *authPassword != "" {
-		log.Printf("Basic authentication enabled")
+
+	var err error
+	logger, err = setupLogger()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger.Info("starting arpwatch exporter", "address", *listenAddress)
+	logger.Info("metrics endpoint configured", "path", *metricsPath)
+	logger.Info("reading arpwatch data", "file", *arpwatchFile)
+
+	mode, err := resolveAuthMode()
+	if err != nil {
+		fatal("invalid auth mode", "err", err)
+	}
+	logger.Info("authentication mode configured", "mode", mode)
+
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		fatal("-web.tls-cert and -web.tls-key must be set together")
+	}
+
+	if mode == "htpasswd" {
+		store, err := newHtpasswdUserStore(*authHtpasswdFile)
+		if err != nil {
+			fatal("error loading htpasswd file", "err", err)
+		}
+		htpasswdStore = store
+		go htpasswdStore.watch(*authHtpasswdReload)
+	}
+
+	if mode == "cert" {
+		if *tlsClientCAFile == "" {
+			fatal("-auth.mode=cert requires -web.tls-client-ca")
+		}
+		if *tlsCertFile == "" || *tlsKeyFile == "" {
+			fatal("-auth.mode=cert requires -web.tls-cert and -web.tls-key")
+		}
+	}
+
+	var authMiddleware func(http.Handler) http.Handler
+	if mode == "cert" {
+		authMiddleware = certAuth
 	} else {
-		log.Printf("Basic authentication disabled")
+		authMiddleware = basicAuth(mode)
+	}
+
+	var oui *OUIStore
+	if *arpwatchOUIFile != "" {
+		oui, err = newOUIStore(*arpwatchOUIFile)
+		if err != nil {
+			fatal("error loading oui file", "err", err)
+		}
+		logger.Info("oui vendor enrichment enabled", "file", *arpwatchOUIFile, "entries", oui.count())
+		go oui.watch(*arpwatchOUIReload)
 	}
-	
-	go updateMetrics()
-	
+
+	collector, err := NewArpwatchCollector(*arpwatchFile, *arpwatchMinScrapeInterval, oui, *arpwatchStateFile, *arpwatchFlipMinInterval)
+	if err != nil {
+		fatal("error loading arpwatch state file", "err", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
 	// Create a new HTTP server mux
 	mux := http.NewServeMux()
-	
+
 	// Expose the registered metrics via HTTP with authentication
-	mux.Handle(*metricsPath, basicAuth(promhttp.Handler()))
-	
+	mux.Handle(*metricsPath, authMiddleware(accessLog(metricsHandler)))
+
 	// Add the home page handler with authentication
-	mux.Handle("/", basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/", authMiddleware(accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Arpwatch Exporter</title></head>
 			<body>
@@ -190,8 +1053,22 @@ func main() {
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
 			</body>
 			</html>`))
-	})))
-	
-	log.Fatal(http.ListenAndServe(*listenAddress, mux))
-}
+	}))))
+
+	server := &http.Server{
+		Addr:    *listenAddress,
+		Handler: mux,
+	}
 
+	if *tlsCertFile != "" && *tlsKeyFile != "" {
+		tlsConfig, err := newTLSConfig(*tlsClientCAFile, mode == "cert")
+		if err != nil {
+			fatal("error configuring TLS", "err", err)
+		}
+		server.TLSConfig = tlsConfig
+		logger.Info("serving metrics over HTTPS")
+		fatal("server exited", "err", server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile))
+	}
+
+	fatal("server exited", "err", server.ListenAndServe())
+}